@@ -0,0 +1,92 @@
+// Package compose implements a scheduler.Scheduler backed by Docker Compose:
+// tasks are services in a single compose project, scaled with
+// `docker-compose up -d --scale <service>=<n>`.
+package compose
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"bitbucket.org/force12io/force12-scheduler/demand"
+	"bitbucket.org/force12io/force12-scheduler/scheduler"
+)
+
+// Scheduler is a scheduler.Scheduler that scales services in a single Docker
+// Compose project.
+type Scheduler struct {
+	project string
+}
+
+// NewScheduler returns a Scheduler for the compose project named by
+// COMPOSE_PROJECT_NAME, Docker Compose's own convention for picking which
+// project's containers a command applies to.
+func NewScheduler() *Scheduler {
+	return &Scheduler{project: os.Getenv("COMPOSE_PROJECT_NAME")}
+}
+
+// args prefixes the project flag (if set) onto a docker-compose subcommand.
+func (s *Scheduler) args(rest ...string) []string {
+	var args []string
+	if s.project != "" {
+		args = append(args, "-p", s.project)
+	}
+	return append(args, rest...)
+}
+
+// InitScheduler is a no-op for compose: services are already declared in
+// docker-compose.yml, so there's nothing to register before scaling one.
+func (s *Scheduler) InitScheduler(name string) error {
+	return nil
+}
+
+// StopStartNTasks scales name to task.Demand instances via `docker-compose up
+// -d --scale`, which compose itself turns into starting or stopping whatever
+// containers are needed to reach the target count.
+func (s *Scheduler) StopStartNTasks(name string, task *demand.Task, ready chan struct{}) (bool, error) {
+	defer func() {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}()
+
+	cmd := exec.Command("docker-compose", s.args("up", "-d", "--scale", fmt.Sprintf("%s=%d", name, task.Demand))...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return true, fmt.Errorf("docker-compose up --scale %s=%d: %v: %s", name, task.Demand, err, stderr.String())
+	}
+
+	task.Requested = task.Demand
+	return true, nil
+}
+
+// CountAllTasks asks compose for every service in the project and how many
+// containers are currently running for it.
+func (s *Scheduler) CountAllTasks() (map[string]int, error) {
+	servicesOut, err := exec.Command("docker-compose", s.args("config", "--services")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker-compose config --services: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, name := range strings.Fields(string(servicesOut)) {
+		idsOut, err := exec.Command("docker-compose", s.args("ps", "-q", name)...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("docker-compose ps -q %s: %v", name, err)
+		}
+		counts[name] = len(strings.Fields(string(idsOut)))
+	}
+	return counts, nil
+}
+
+// ReconcileTasks scales up to scheduler.Concurrency(len(tasks)) services at
+// once: docker-compose up --scale against different services doesn't
+// contend with itself the way two calls against the same service would.
+func (s *Scheduler) ReconcileTasks(ctx context.Context, tasks map[string]demand.Task) (<-chan scheduler.TaskResult, error) {
+	return scheduler.RunPool(ctx, tasks, s.StopStartNTasks)
+}
@@ -0,0 +1,183 @@
+// Package consul implements a demand.Input (and demand.Watcher) backed by
+// Consul's KV store.
+package consul
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// blockingWait bounds how long a single blocking KV query sits before
+// Consul returns anyway, so Watch notices a dead connection and re-issues
+// the query rather than blocking forever.
+const blockingWait = "5m"
+
+// watchErrorBackoff is how long Watch pauses after a failed KV query before
+// retrying, so a sustained Consul outage degrades to a slow retry cadence
+// instead of spinning in a tight request loop.
+const watchErrorBackoff = 5 * time.Second
+
+// DemandModel is a demand.Input (and demand.Watcher) that reads task
+// "foo"'s demand from the integer stored at Consul KV key
+// "force12/demand/foo".
+type DemandModel struct {
+	addr   string
+	client *http.Client
+}
+
+// NewDemandModel returns a DemandModel pointed at the Consul agent named by
+// CONSUL_HTTP_ADDR (defaulting to the local agent).
+func NewDemandModel() *DemandModel {
+	addr := os.Getenv("CONSUL_HTTP_ADDR")
+	if addr == "" {
+		addr = "http://localhost:8500"
+	}
+	return &DemandModel{addr: addr, client: http.DefaultClient}
+}
+
+func (d *DemandModel) key(taskName string) string {
+	return "force12/demand/" + taskName
+}
+
+// kvEntry decodes the fields we care about from a Consul
+// GET /v1/kv/<key> response entry - notably, Value is base64 encoded.
+type kvEntry struct {
+	Value []byte
+}
+
+func (e *kvEntry) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Value string
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(raw.Value)
+	if err != nil {
+		return err
+	}
+	e.Value = decoded
+	return nil
+}
+
+// get issues one KV query for taskName, blocking against index (if
+// non-zero) for up to wait. It returns the current demand and the
+// X-Consul-Index the response was served at.
+func (d *DemandModel) get(ctx context.Context, taskName string, index uint64, wait string) (int, uint64, error) {
+	q := url.Values{}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", wait)
+	}
+
+	reqURL := fmt.Sprintf("%s/v1/kv/%s?%s", d.addr, d.key(taskName), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("consul KV GET %s: %s", d.key(taskName), resp.Status)
+	}
+
+	newIndex, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("consul KV GET %s: bad X-Consul-Index: %v", d.key(taskName), err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var entries []kvEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return 0, 0, err
+	}
+	if len(entries) == 0 {
+		return 0, newIndex, nil
+	}
+
+	value, err := strconv.Atoi(string(entries[0].Value))
+	if err != nil {
+		return 0, 0, fmt.Errorf("consul KV GET %s: non-integer value %q", d.key(taskName), entries[0].Value)
+	}
+
+	return value, newIndex, nil
+}
+
+// GetDemand polls taskName's current demand once, without blocking. It
+// satisfies demand.Input.
+func (d *DemandModel) GetDemand(taskName string) (int, error) {
+	value, _, err := d.get(context.Background(), taskName, 0, "")
+	return value, err
+}
+
+// Watch issues blocking KV queries against taskName's key, re-issuing with
+// the last-seen X-Consul-Index so each call only returns once the value has
+// actually changed. It satisfies demand.Watcher.
+func (d *DemandModel) Watch(ctx context.Context, taskName string) (<-chan int, error) {
+	// Seed with a non-blocking read so we have a starting index to block
+	// against.
+	seed, index, err := d.get(ctx, taskName, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan int)
+	go func() {
+		defer close(out)
+
+		select {
+		case out <- seed:
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			value, newIndex, err := d.get(ctx, taskName, index, blockingWait)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("consul watch %s: %v", taskName, err)
+				select {
+				case <-time.After(watchErrorBackoff):
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			if newIndex == index {
+				// Consul hit its wait timeout with no change; re-issue.
+				continue
+			}
+			index = newIndex
+
+			select {
+			case out <- value:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
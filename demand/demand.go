@@ -0,0 +1,46 @@
+// Package demand defines the types shared between demand models (rng,
+// consul, ...) and schedulers (compose, marathon, ...): how many instances
+// of a task are wanted, and how that want is observed.
+package demand
+
+import "context"
+
+// Input is implemented by demand models that report how many instances of a
+// task are currently wanted.
+type Input interface {
+	GetDemand(taskName string) (int, error)
+}
+
+// Watcher is an optional extension to Input, implemented by demand models
+// that can push demand changes as they happen instead of waiting to be
+// polled (e.g. consul, on top of Consul's blocking KV queries). Models that
+// have nothing to block on (e.g. rng) simply don't implement it, and
+// callers fall back to polling GetDemand.
+type Watcher interface {
+	// Watch starts watching taskName's demand and returns a channel that
+	// first receives its current value and then each subsequent change.
+	// The channel is closed once ctx is cancelled.
+	Watch(ctx context.Context, taskName string) (<-chan int, error)
+}
+
+// Task is one schedulable tier: a name known to the demand model and the
+// scheduler, how many instances are currently demanded and how many the
+// scheduler has already requested, plus the parameters the WDRR scheduler
+// uses to share a fixed slot pool across many such tasks.
+type Task struct {
+	// FamilyName is the app/family identifier the scheduler back-end uses
+	// to start and stop instances of this task.
+	FamilyName string
+
+	Demand    int // number of instances currently demanded
+	Requested int // number of instances we've already asked the scheduler for
+
+	// Weight is this task's share of the slot pool relative to the other
+	// tasks' weights, used by scheduler/wdrr when total demand exceeds
+	// capacity.
+	Weight int
+
+	// MaxDemand caps how many instances this task will ever be allocated,
+	// regardless of weight or demand. Zero means unlimited.
+	MaxDemand int
+}
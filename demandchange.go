@@ -1,80 +1,195 @@
 package main
 
 import (
+	"context"
 	"log"
+	"time"
 
 	"bitbucket.org/force12io/force12-scheduler/demand"
 	"bitbucket.org/force12io/force12-scheduler/scheduler"
+	"bitbucket.org/force12io/force12-scheduler/scheduler/costtracker"
+	"bitbucket.org/force12io/force12-scheduler/scheduler/wdrr"
+	"bitbucket.org/force12io/force12-scheduler/state"
 )
 
-// handleDemandChange checks the new demand
-func handleDemandChange(input demand.Input, s scheduler.Scheduler, scaling_ready *bool, ready chan struct{}, ts map[string]demand.Task) error {
-	var err error = nil
-	var demandChanged bool
+// Reconciler ties together everything needed to turn an observed demand
+// change into scheduler calls: the back-end itself, the WDRR allocator that
+// shares the fixed slot pool across tasks, and (optionally) a cost tracker
+// that throttles how fast changes are dispatched to the back-end and a
+// state store that records what was asked for, for history and crash
+// recovery.
+type Reconciler struct {
+	Sched    scheduler.Scheduler
+	Alloc    *wdrr.Scheduler
+	Tracker  *costtracker.Tracker // nil disables cost-based throttling
+	Store    state.Store          // nil disables history/crash-recovery persistence
+	Capacity int
+
+	// scalingReady tracks, per task name, whether the scheduler is ready to
+	// accept another change for that task straight away. A name that's
+	// absent (the normal case) is ready; a name is only ever set to false
+	// for the brief window where ReconcileTasks reported it's still busy, so
+	// one stuck task holds up only itself, not the rest of the batch.
+	scalingReady map[string]bool
+}
 
-	demandChanged, err = update(input, ts)
+func (r *Reconciler) ready(name string) bool {
+	ready, seen := r.scalingReady[name]
+	return !seen || ready
+}
+
+// HandleDemandChange polls every task's demand and, if anything changed,
+// reconciles the scheduler towards the result. This is the fallback path
+// for demand models that don't implement demand.Watcher (e.g. rng) - watch-
+// capable models call Reconcile directly as each event arrives, so they
+// never need this full poll.
+// The returned bool reports whether a demand change was observed but not
+// yet fully applied (some tasks were still busy from a previous change, or
+// the cost tracker deferred the whole batch) - callers use it to remember
+// to retry once things free up.
+func (r *Reconciler) HandleDemandChange(input demand.Input, deferredApply chan<- struct{}, ts map[string]demand.Task) (bool, error) {
+	demandChanged, err := update(input, ts)
 	if err != nil {
 		log.Printf("Failed to get new demand. %v", err)
-		return err
+		return false, err
+	}
+
+	if !demandChanged {
+		return false, nil
+	}
+
+	applied, err := r.Reconcile(deferredApply, ts)
+	return !applied, err
+}
+
+// Reconcile shares the fixed slot pool out across ts according to Alloc's
+// Weight/MaxDemand/StrictPriority rules and tells the scheduler to move
+// towards the result. Callers only invoke this once they already know
+// demand changed, whether that came from polling every task or a single
+// watch event.
+//
+// If a Tracker is set and it judges the back-end too close to its measured
+// limit to take this change right now, Reconcile doesn't call the scheduler
+// at all - it arranges for deferredApply to fire once the tracker's budget
+// should have recovered, trusting the caller to re-run Reconcile at that
+// point with whatever the latest demand turns out to be by then.
+//
+// Tasks are dispatched to the scheduler concurrently via ReconcileTasks, so
+// one slow task's reply doesn't hold up the others; a task that's still busy
+// from a previous round is skipped this time round rather than piled on.
+//
+// The returned bool reports whether every task in ts was actually part of
+// this round's batch - callers use it to decide whether they still owe a
+// re-run once the tasks that were skipped free up, rather than assuming
+// every call flushes all of ts.
+func (r *Reconciler) Reconcile(deferredApply chan<- struct{}, ts map[string]demand.Task) (bool, error) {
+	// Share the fixed slot pool out across tasks according to their
+	// Weight/MaxDemand/StrictPriority, rather than asking the scheduler
+	// for each task's raw (and possibly over-subscribed) demand.
+	allocation := r.Alloc.AllocateSlots(ts, r.Capacity)
+
+	changed := 0
+	batch := make(map[string]demand.Task)
+	for name, task := range ts {
+		if d := allocation[name] - task.Requested; d != 0 {
+			if d < 0 {
+				d = -d
+			}
+			changed += d
+		}
+		// Only the batch carries the allocation; ts keeps each task's
+		// observed demand so the next round allocates from that again.
+		task.Demand = allocation[name]
+
+		if r.ready(name) {
+			batch[name] = task
+		} else {
+			log.Printf("%s still has a scaling change outstanding - skipping it this round", name)
+		}
+	}
+
+	if len(batch) == 0 {
+		return false, nil
+	}
+
+	if r.Tracker != nil && changed > 0 {
+		if wait, ok := r.Tracker.Reserve(changed); !ok {
+			log.Printf("Cost tracker is limit-bound - deferring this change for %v", wait)
+			time.AfterFunc(wait, func() {
+				select {
+				case deferredApply <- struct{}{}:
+				default:
+					// a deferred apply is already pending; it'll pick up
+					// whatever ts looks like by the time it fires.
+				}
+			})
+			return false, nil
+		}
 	}
 
-	if demandChanged {
-		// Ask the scheduler to make the changes
+	if r.scalingReady == nil {
+		r.scalingReady = make(map[string]bool, len(ts))
+	}
+
+	results, err := r.Sched.ReconcileTasks(context.Background(), batch)
+	if err != nil {
+		return false, err
+	}
 
-		// TODO!! We need to send these to compose all at once
+	for res := range results {
+		r.scalingReady[res.Name] = res.Ready
 
-		for name, task := range ts {
-			// If we already have a scaling change outstanding, we can't do another one
-			if !*scaling_ready {
-				log.Printf("Scale change still outstanding - demand changes coming too fast to handle!")
-				// This isn't an error - we simply don't try to update scale until the scheduler is ready
-				return nil
+		if res.Err != nil {
+			log.Printf("Failed to reconcile %s. %v", res.Name, res.Err)
+			err = res.Err
+			continue
+		}
+
+		current := ts[res.Name]
+		before := current.Requested
+		current.Requested = res.Task.Requested
+		ts[res.Name] = current
+
+		if r.Tracker != nil {
+			if d := res.Task.Requested - before; d != 0 {
+				if d < 0 {
+					d = -d
+				}
+				r.Tracker.Observe(d, res.Elapsed)
 			}
+		}
 
-			*scaling_ready, err = s.StopStartNTasks(name, &task, ready)
-			if err != nil {
-				log.Printf("Failed to start %s tasks. %v", name, err)
-				break
+		if r.Store != nil {
+			if saveErr := r.Store.Save(res.Name, time.Now(), res.Task.Demand, res.Task.Requested); saveErr != nil {
+				log.Printf("Failed to persist state for %s. %v", res.Name, saveErr)
 			}
-			ts[name] = task
 		}
 	}
 
-	return err
+	return len(batch) == len(ts), err
 }
 
-// update checks for changes in demand, returning true if demand changed
-// TODO! Make this less tied to the p1 / p2 simple model
+// update polls the demand model for every task's current demand, returning
+// true if any task's demand changed since the last call.
 func update(input demand.Input, ts map[string]demand.Task) (bool, error) {
 	var err error = nil
 	var demandchange bool
 
-	var p1 demand.Task = ts[p1TaskName]
-	var p2 demand.Task = ts[p2TaskName]
+	for name, task := range ts {
+		oldDemand := task.Demand
 
-	// Save the old demand
-	oldP1Demand := p1.Demand
-	oldP2Demand := p2.Demand
+		task.Demand, err = input.GetDemand(name)
+		if err != nil {
+			log.Printf("Failed to get new demand for task %s. %v", name, err)
+			return false, err
+		}
+		ts[name] = task
 
-	// TODO! In this super-simple RNG model we have to get p1 first so that p2 gets whatever capacity is left over.
-	p1.Demand, err = input.GetDemand(p1TaskName)
-	if err != nil {
-		log.Printf("Failed to get new demand for task %s. %v", p1TaskName, err)
-		return false, err
-	}
-	p2.Demand, err = input.GetDemand(p2TaskName)
-	if err != nil {
-		log.Printf("Failed to get new demand for task %s. %v", p2TaskName, err)
-		return false, err
+		if task.Demand != oldDemand {
+			demandchange = true
+		}
 	}
 
-	//Has the demand changed?
-	demandchange = (p1.Demand != oldP1Demand) || (p2.Demand != oldP2Demand)
-
-	// Update tasks map
-	ts[p1TaskName] = p1
-	ts[p2TaskName] = p2
-
 	// This is where we could decide whether this is a significant enough
 	// demand change to do anything
 
@@ -82,3 +197,13 @@ func update(input demand.Input, ts map[string]demand.Task) (bool, error) {
 
 	return demandchange, err
 }
+
+// applyDemand records a single watch event's new demand for name, returning
+// whether it actually changed.
+func applyDemand(ts map[string]demand.Task, name string, value int) bool {
+	task := ts[name]
+	changed := task.Demand != value
+	task.Demand = value
+	ts[name] = task
+	return changed
+}
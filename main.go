@@ -20,12 +20,9 @@
 // make very simplistic judgments because they have limited time and cpu and they act at a per packet level. Force12 has the capability
 // of making far more sophisticated judgements, although even fairly simple ones will still provide a significant new service.
 //
-// This prototype is a bare bones implementation of Force12.io that recognises only 1 demand type:
-// randomised demand for a priority 1 service. Resources are allocated to meet this demand for priority 1, and spare resource can
-// be used for a priority 2 service.
-//
-// These demand type examples have been chosen purely for simplicity of demonstration. In the future more demand types
-// will be offered
+// Force12 schedules any number of priority tiers (see taskSpec and scheduler/wdrr) across a fixed pool of containers. The default
+// configuration reproduces the original 2-tier prototype: a priority 1 service that always gets what it demands, and a priority 2
+// service that gets whatever's left.
 //
 // V1 - Force12.io reacts to increased demand by starting/stopping containers on the slaves already in play.
 //
@@ -34,11 +31,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"bitbucket.org/force12io/force12-scheduler/compose"
@@ -47,121 +47,134 @@ import (
 	"bitbucket.org/force12io/force12-scheduler/marathon"
 	"bitbucket.org/force12io/force12-scheduler/rng"
 	"bitbucket.org/force12io/force12-scheduler/scheduler"
+	"bitbucket.org/force12io/force12-scheduler/scheduler/costtracker"
+	"bitbucket.org/force12io/force12-scheduler/scheduler/wdrr"
+	"bitbucket.org/force12io/force12-scheduler/state"
+	"bitbucket.org/force12io/force12-scheduler/state/etcd"
+	"bitbucket.org/force12io/force12-scheduler/state/local"
 )
 
 type sendStatePayload struct {
-	CreatedAt          int64 `json:"createdAt"`
-	Priority1Requested int   `json:"priority1Requested"`
-	Priority1Running   int   `json:"priority1Running"`
-	Priority2Running   int   `json:"priority2Running"`
+	CreatedAt   int64                     `json:"createdAt"`
+	Requested   map[string]int            `json:"requested"`
+	Running     map[string]int            `json:"running"`
+	CostTracker *costtracker.State        `json:"costTracker,omitempty"`
+	History     map[string][]state.Sample `json:"history,omitempty"`
 }
 
-const const_sleep = 100          //milliseconds
-const const_sendstate_sleeps = 5 // number of sleeps before we send state on the API
-const const_stopsleep = 250      //milliseconds pause between stopping and restarting containers
-const const_p1demandstart int = 5
-const const_p2demandstart int = 4
+const const_poll_interval = 100 * time.Millisecond      // fallback poll cadence for demand models that can't Watch
+const const_sendstate_interval = 500 * time.Millisecond // cadence for sending state to the API
+const const_stopsleep = 250                             //milliseconds pause between stopping and restarting containers
 const const_maxcontainers int = 9
+const const_cost_bucket = 30 * time.Second    // how much scheduling "cost" the cost tracker lets a back-end owe before throttling
+const const_history_window = 10 * time.Minute // how much state history sendStateToAPI reports per task
 
 var p1TaskName string
 var p2TaskName string
-var p1FamilyName string
-var p2FamilyName string
-
-type Demand struct {
-	sched scheduler.Scheduler
-	input demand.Input
 
-	p1demand    int // number of Priority 1 tasks demanded
-	p2demand    int
-	p1requested int // indicates how many P1 tasks we've tried to kick off.
-	p2requested int
+// taskSpec declares one schedulable tier: its name, its WDRR weight and the
+// most instances it will ever be allocated. A tier with StrictPriority set
+// bypasses WDRR and is serviced to its full demand (capped by MaxDemand)
+// before the rest of the pool is shared out.
+type taskSpec struct {
+	Name           string
+	FamilyName     string
+	Weight         int
+	MaxDemand      int
+	StrictPriority bool
 }
 
-// set returns values that were there (p1, p2)
-// if provided value is -1 don't update, demand will always be between 0 and const_maxcontainers
-func (d *Demand) set(p1, p2 int) (int, int) {
-	//d.mu.Lock()
-	p1old := d.p1demand
-	p2old := d.p2demand
-	if p2 != -1 {
-		d.p2demand = p2
-	}
-	if p1 != -1 {
-		d.p1demand = p1
+// defaultTaskSpecs reproduces the original hard-coded behaviour: P1 is
+// strict-priority up to const_maxcontainers, and P2 gets whatever P1
+// doesn't use.
+func defaultTaskSpecs() []taskSpec {
+	return []taskSpec{
+		{Name: p1TaskName, FamilyName: os.Getenv("F12_PRIORITY1_FAMILY"), Weight: 1, MaxDemand: const_maxcontainers, StrictPriority: true},
+		{Name: p2TaskName, FamilyName: os.Getenv("F12_PRIORITY2_FAMILY"), Weight: 1, MaxDemand: const_maxcontainers},
 	}
-	//d.mu.Unlock()
-	return p1old, p2old
 }
 
-// get returns client, server AEC - Combine this with the set to reduce code
-func (d *Demand) get() (int, int) {
-	return d.p1demand, d.p2demand
-}
+// parseTaskSpecs parses F12_TASKS, a comma-separated list of
+// "name:familyName:weight:maxDemand" entries. Prefixing a name with "!"
+// marks it as the strict-priority tier.
+func parseTaskSpecs(s string) ([]taskSpec, error) {
+	var specs []taskSpec
 
-// handle processes a change in demand
-// Note that handle will make any judgment on what to do with a demand
-// change, including potentially nothing.
-func (d *Demand) handle() error {
-	var err error
-	err = d.sched.StopStartNTasks(p1TaskName, p1FamilyName, d.p1demand, d.p1requested)
-	if err != nil {
-		log.Printf("Failed to start Priority1 tasks. %v", err)
-	}
-	d.sched.StopStartNTasks(p2TaskName, p2FamilyName, d.p2demand, d.p2requested)
-	if err != nil {
-		log.Printf("Failed to start Priority2 tasks. %v", err)
-	}
-
-	return err
-}
-
-// update checks for changes in demand, returning true if demand changed
-// Note that this function makes no judgement on whether a demand change is
-// significant. handle() will determine that.
-func (d *Demand) update() bool {
-	//log.Println("demand update check.")
-	var demandchange bool
+	for _, entry := range strings.Split(s, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("bad F12_TASKS entry %q: want name:family:weight:maxDemand", entry)
+		}
 
-	newP1Demand, err := d.input.GetDemand("priority1-demand")
-	if err != nil {
-		log.Printf("Failed to get new demand. %v", err)
-		return false
-	}
-	//log.Printf("container count %v\n", container_count)
-	newP2Demand := const_maxcontainers - newP1Demand
+		name := fields[0]
+		strictPriority := strings.HasPrefix(name, "!")
+		name = strings.TrimPrefix(name, "!")
 
-	//Update our saved demand
-	oldP1Demand, oldP2Demand := d.set(newP1Demand, newP2Demand)
+		weight, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("bad weight in F12_TASKS entry %q: %v", entry, err)
+		}
+		if !strictPriority && weight < 1 {
+			return nil, fmt.Errorf("bad weight in F12_TASKS entry %q: want >= 1 for a non-strict-priority tier", entry)
+		}
 
-	//Has the demand changed?
-	demandchange = (newP1Demand != oldP1Demand) || (newP2Demand != oldP2Demand)
+		maxDemand, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("bad maxDemand in F12_TASKS entry %q: %v", entry, err)
+		}
 
-	if demandchange {
-		log.Printf("P1 demand changed from %d to %d", oldP1Demand, newP1Demand)
+		specs = append(specs, taskSpec{
+			Name:           name,
+			FamilyName:     fields[1],
+			Weight:         weight,
+			MaxDemand:      maxDemand,
+			StrictPriority: strictPriority,
+		})
 	}
 
-	return demandchange
+	return specs, nil
 }
 
 // sendStateToAPI checks the current state of cluster (or single node) and sends that
 // state to the f12 API
-func sendStateToAPI(currentdemand *Demand) error {
-	count1, count2, err := currentdemand.sched.CountAllTasks()
+func sendStateToAPI(s scheduler.Scheduler, tracker *costtracker.Tracker, store state.Store, ts map[string]demand.Task) error {
+	running, err := s.CountAllTasks()
 	if err != nil {
 		return fmt.Errorf("Failed to get state err %v", err)
 	}
 
+	requested := make(map[string]int, len(ts))
+	for name, task := range ts {
+		requested[name] = task.Demand
+	}
+
 	// Submit a PUT request to the API
 	// Note the magic hardcoded string is the user ID, we need to pass this in in some way. ENV VAR?
 	url := getBaseF12APIUrl() + "/metrics/" + "5k5gk"
 	log.Printf("API PUT: %s", url)
 
 	payload := sendStatePayload{
-		CreatedAt:          time.Now().Unix(),
-		Priority1Requested: currentdemand.p1demand,
-		Priority1Running:   count1,
-		Priority2Running:   count2,
+		CreatedAt: time.Now().Unix(),
+		Requested: requested,
+		Running:   running,
+	}
+	if tracker != nil {
+		trackerState := tracker.State()
+		payload.CostTracker = &trackerState
+	}
+
+	if store != nil {
+		since := time.Now().Add(-const_history_window)
+		history := make(map[string][]state.Sample, len(ts))
+		for name := range ts {
+			samples, histErr := store.History(name, since)
+			if histErr != nil {
+				log.Printf("Failed to read state history for %s. %v", name, histErr)
+				continue
+			}
+			history[name] = samples
+		}
+		payload.History = history
 	}
 
 	w := &bytes.Buffer{}
@@ -210,13 +223,41 @@ func getEnvOrDefault(name string, defaultValue string) string {
 	return v
 }
 
-// For the simple prototype, Force12.io sits in a loop checking for demand changes every X milliseconds
-// In phase 2 we'll add a reactive mode where appropriate.
-//
-// Note - we don't route messages from demandcheckers to demandhandlers using channels because we want new values
-// to override old values. Queued history is of no importance here.
+// demandEvent carries one task's new demand, as pushed by a
+// demand.Watcher's channel.
+type demandEvent struct {
+	name  string
+	value int
+}
+
+// forwardDemand relays values from a single task's Watch channel onto the
+// shared events channel, tagging each with its task name, until in closes
+// or ctx is cancelled.
+func forwardDemand(ctx context.Context, name string, in <-chan int, events chan<- demandEvent) {
+	for {
+		select {
+		case value, ok := <-in:
+			if !ok {
+				return
+			}
+			select {
+			case events <- demandEvent{name: name, value: value}:
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Force12.io sits in a loop reacting to demand changes as they're observed. Demand models that implement
+// demand.Watcher (e.g. consul, on top of Consul's blocking KV queries) push changes onto a channel the
+// moment they happen; models that can't (e.g. rng) are polled instead, on const_poll_interval.
 //
-// Also for simplicity this first release is concurrency free (single threaded)
+// Note - we don't route queued history through the events channel: while a scaling change is already
+// outstanding, later events for the same tasks simply overwrite ts's pending values, so only the latest
+// demand is ever applied once the scheduler is ready again. Queued history is of no importance here.
 func main() {
 	var err error
 	// TODO! Make it so you can send in settings on the command line
@@ -225,9 +266,6 @@ func main() {
 	var sendstate string = getEnvOrDefault("F12_SEND_STATE_TO_API", "true")
 	p1TaskName = getEnvOrDefault("F12_PRIORITY1_TASK", "priority1-demand")
 	p2TaskName = getEnvOrDefault("F12_PRIORITY2_TASK", "priority2-demand")
-	// TODO!! FInd out what CLIENT/SERVER_FAMILY should default to
-	p1FamilyName = os.Getenv("F12_PRIORITY1_FAMILY")
-	p2FamilyName = os.Getenv("F12_PRIORITY2_FAMILY")
 
 	var di demand.Input
 	var s scheduler.Scheduler
@@ -256,61 +294,224 @@ func main() {
 		return
 	}
 
-	currentdemand := Demand{
-		input: di,
+	specs := defaultTaskSpecs()
+	if raw := os.Getenv("F12_TASKS"); raw != "" {
+		specs, err = parseTaskSpecs(raw)
+		if err != nil {
+			log.Printf("Bad F12_TASKS: %v", err)
+			return
+		}
 	}
-	currentdemand.set(const_p1demandstart, const_p2demandstart)
 
-	// Initialise container types
-	err = currentdemand.sched.InitScheduler(p1TaskName)
-	if err != nil {
-		log.Printf("Failed to start P1 task. %v", err)
-		return
+	store := newStateStore()
+
+	// Count what's actually running before touching anything, so a task
+	// that's already live from a previous run is reconciled rather than
+	// re-initialized from scratch - InitScheduler is only for tasks the
+	// back-end has genuinely never seen.
+	running, countErr := s.CountAllTasks()
+	if countErr != nil {
+		log.Printf("Failed to count existing tasks, falling back to InitScheduler for all: %v", countErr)
+		running = nil
 	}
 
-	err = currentdemand.sched.InitScheduler(p2TaskName)
-	if err != nil {
-		log.Printf("Failed to start P2 task. %v", err)
-		return
+	alloc := wdrr.NewScheduler()
+	ts := make(map[string]demand.Task, len(specs))
+	for _, spec := range specs {
+		if spec.StrictPriority {
+			alloc.StrictPriority = spec.Name
+		}
+
+		task := demand.Task{
+			FamilyName: spec.FamilyName,
+			Weight:     spec.Weight,
+			MaxDemand:  spec.MaxDemand,
+		}
+
+		if store != nil {
+			if last, ok, lastErr := store.Last(spec.Name); lastErr != nil {
+				log.Printf("Failed to read previous state for %s. %v", spec.Name, lastErr)
+			} else if ok {
+				task.Demand = last.Demand
+			}
+		}
+
+		if count, known := running[spec.Name]; known {
+			log.Printf("%s already has %d instances running - reconciling instead of re-initializing", spec.Name, count)
+			task.Requested = count
+		} else if err = s.InitScheduler(spec.Name); err != nil {
+			log.Printf("Failed to init task %s. %v", spec.Name, err)
+			return
+		}
+
+		ts[spec.Name] = task
 	}
 
-	var demandchangeflag bool
-	demandchangeflag = currentdemand.update()
-	demandchangeflag = true
+	tracker := newCostTracker(schedulerType, s, specs, ts)
+	reconciler := &Reconciler{Sched: s, Alloc: alloc, Tracker: tracker, Store: store, Capacity: const_maxcontainers}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// If di can push changes as they happen, watch every task instead of
+	// polling. If it can't (e.g. rng), or a watch fails to start, fall back
+	// to polling all of them on const_poll_interval.
+	events := make(chan demandEvent, len(ts))
+	var pollC <-chan time.Time
+
+	watcher, canWatch := di.(demand.Watcher)
+	if canWatch {
+		// Watches are all-or-nothing: started under their own cancellable
+		// context so that if one task fails partway through, the watches
+		// already started for earlier tasks are torn down before falling
+		// back to polling - otherwise they'd keep forwarding events
+		// alongside the poll path and every task they cover would get
+		// reconciled twice.
+		watchCtx, cancelWatch := context.WithCancel(ctx)
+		for name := range ts {
+			ch, watchErr := watcher.Watch(watchCtx, name)
+			if watchErr != nil {
+				log.Printf("Failed to watch %s, falling back to polling: %v", name, watchErr)
+				canWatch = false
+				cancelWatch()
+				break
+			}
+			go forwardDemand(watchCtx, name, ch, events)
+		}
+		if canWatch {
+			defer cancelWatch()
+		}
+	}
+	if !canWatch {
+		ticker := time.NewTicker(const_poll_interval)
+		defer ticker.Stop()
+		pollC = ticker.C
+	}
+
+	sendTicker := time.NewTicker(const_sendstate_interval)
+	defer sendTicker.Stop()
 
-	var sleepcount int = 0
-	var sleep time.Duration
-	sleep = const_sleep * time.Millisecond
+	deferredApply := make(chan struct{}, 1)
+	pendingChange := false
 
 	for {
-		//Update currentdemand with latest client and server demand, if changed, set flag
-		demandchangeflag = currentdemand.update()
-		if demandchangeflag {
-			// See how many tasks we should have already
-			currentdemand.p1requested, currentdemand.p2requested, err = currentdemand.sched.CountAllTasks()
-			if err != nil {
-				log.Printf("Failed to count tasks. %v", err)
+		select {
+		case ev := <-events:
+			if applyDemand(ts, ev.name, ev.value) {
+				pendingChange = true
 			}
-			//make any changes dictated by the new demand level
-			err = currentdemand.handle()
-			if err != nil {
-				log.Printf("Failed to handle demand change. %v", err)
+			if pendingChange {
+				applied, reconcileErr := reconciler.Reconcile(deferredApply, ts)
+				if reconcileErr != nil {
+					log.Printf("Failed to handle demand change. %v", reconcileErr)
+				}
+				pendingChange = !applied
+			}
+			// If it wasn't fully applied - some tasks were still busy from
+			// a previous round, or the cost tracker deferred the whole
+			// batch - ts already holds the newest demand, and pendingChange
+			// stays true so <-deferredApply or the next event picks it up,
+			// dropping anything that arrives in between.
+
+		case <-deferredApply:
+			if pendingChange {
+				applied, reconcileErr := reconciler.Reconcile(deferredApply, ts)
+				if reconcileErr != nil {
+					log.Printf("Failed to handle demand change. %v", reconcileErr)
+				}
+				pendingChange = !applied
 			}
-		}
 
-		time.Sleep(sleep)
-		sleepcount++
-		if sleepcount == const_sendstate_sleeps {
-			sleepcount = 0
+		case <-pollC:
+			pending, pollErr := reconciler.HandleDemandChange(di, deferredApply, ts)
+			if pollErr != nil {
+				log.Printf("Failed to handle demand change. %v", pollErr)
+			}
+			pendingChange = pending
 
+		case <-sendTicker.C:
 			//Periodically send state to the API if required
 			if sendstate == "true" {
-				err = sendStateToAPI(&currentdemand)
-				if err != nil {
+				if err = sendStateToAPI(s, tracker, store, ts); err != nil {
 					log.Printf("Failed to send state. %v", err)
 				}
 			}
 		}
+	}
+}
+
+// newStateStore builds the state.Store backing demand history and crash
+// recovery, chosen by F12_STATE_STORE: LOCAL (the default), a JSON file
+// under $HOME/.microscaling/, or ETCD, for sharing state across replicas.
+// A nil return disables history/crash-recovery rather than failing main
+// outright - it's a diagnostic nicety, not something Force12 can't run
+// without.
+func newStateStore() state.Store {
+	switch backend := getEnvOrDefault("F12_STATE_STORE", "LOCAL"); backend {
+	case "ETCD":
+		return etcd.NewStore(const_history_window)
+	case "LOCAL":
+		store, err := local.NewStore("", const_history_window)
+		if err != nil {
+			log.Printf("Failed to open local state store, history/crash-recovery disabled: %v", err)
+			return nil
+		}
+		return store
+	default:
+		log.Printf("Bad value for F12_STATE_STORE: %s, history/crash-recovery disabled", backend)
+		return nil
+	}
+}
+
+// newCostTracker builds the costtracker.Tracker used to throttle changes to
+// the chosen scheduler back-end, seeding its cost-per-delta estimate and
+// correction factor from a previous run's persisted calibration if there is
+// one, or by benchmarking the first task otherwise. Benchmarking is only
+// ever done against a task that has nothing running yet - calibrating
+// against a task reconciled from a crash (or any other real traffic) would
+// scale it down to zero live instances for the duration of the benchmark.
+func newCostTracker(backend string, s scheduler.Scheduler, specs []taskSpec, ts map[string]demand.Task) *costtracker.Tracker {
+	if cost, correction, ok := costtracker.LoadCalibration(backend); ok {
+		return costtracker.NewTracker(backend, cost, correction, const_cost_bucket)
+	}
+
+	if len(specs) == 0 {
+		return costtracker.NewTracker(backend, 0, 1, const_cost_bucket)
+	}
+
+	name := specs[0].Name
+	original := ts[name]
+	if original.Requested != 0 {
+		log.Printf("%s already has instances running, skipping %s cost tracker calibration and starting unthrottled", name, backend)
+		return costtracker.NewTracker(backend, 0, 1, const_cost_bucket)
+	}
+
+	calibrationTask := original
+
+	cost, err := costtracker.Calibrate(func(n int) error {
+		calibrationTask.Demand = n
+		if _, startErr := s.StopStartNTasks(name, &calibrationTask, make(chan struct{}, 1)); startErr != nil {
+			return startErr
+		}
+		calibrationTask.Demand = 0
+		_, stopErr := s.StopStartNTasks(name, &calibrationTask, make(chan struct{}, 1))
+		return stopErr
+	})
+	if err != nil {
+		log.Printf("Failed to calibrate %s cost tracker, starting unthrottled: %v", backend, err)
+		ts[name] = original
+		return costtracker.NewTracker(backend, 0, 1, const_cost_bucket)
+	}
 
+	// original already reflects "nothing running", which is the guard above
+	// guaranteed was true before the benchmark started - restore it rather
+	// than trusting the benchmark's own idea of where calibrationTask ended
+	// up.
+	ts[name] = original
+
+	if err := costtracker.SaveCalibration(backend, cost, 1); err != nil {
+		log.Printf("Failed to persist %s cost tracker calibration: %v", backend, err)
 	}
+
+	return costtracker.NewTracker(backend, cost, 1, const_cost_bucket)
 }
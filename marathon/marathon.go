@@ -0,0 +1,143 @@
+// Package marathon implements a scheduler.Scheduler backed by Mesos/Marathon:
+// tasks are Marathon apps, scaled by PUTting a new instance count.
+package marathon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"bitbucket.org/force12io/force12-scheduler/demand"
+	"bitbucket.org/force12io/force12-scheduler/scheduler"
+)
+
+// Scheduler is a scheduler.Scheduler that scales Marathon apps.
+type Scheduler struct {
+	addr   string
+	client *http.Client
+}
+
+// NewScheduler returns a Scheduler pointed at the Marathon instance named by
+// MARATHON_ADDR (defaulting to the local agent).
+func NewScheduler() *Scheduler {
+	addr := os.Getenv("MARATHON_ADDR")
+	if addr == "" {
+		addr = "http://localhost:8080"
+	}
+	return &Scheduler{addr: addr, client: http.DefaultClient}
+}
+
+func (s *Scheduler) appURL(name string) string {
+	return fmt.Sprintf("%s/v2/apps/%s", s.addr, name)
+}
+
+// InitScheduler confirms app name already exists in Marathon; apps
+// themselves are expected to be deployed out of band, so there's nothing for
+// Force12 to create before it can start scaling one.
+func (s *Scheduler) InitScheduler(name string) error {
+	req, err := http.NewRequest("GET", s.appURL(name), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("marathon GET %s: %s", s.appURL(name), resp.Status)
+	}
+	return nil
+}
+
+type scaleRequest struct {
+	Instances int `json:"instances"`
+}
+
+// StopStartNTasks scales name to task.Demand instances by PUTting a new
+// instance count to Marathon; Marathon itself decides which instances to
+// stop or start to get there.
+func (s *Scheduler) StopStartNTasks(name string, task *demand.Task, ready chan struct{}) (bool, error) {
+	defer func() {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}()
+
+	body, err := json.Marshal(scaleRequest{Instances: task.Demand})
+	if err != nil {
+		return true, err
+	}
+
+	req, err := http.NewRequest("PUT", s.appURL(name), bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("marathon PUT %s: %v", s.appURL(name), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return true, fmt.Errorf("marathon PUT %s: %s", s.appURL(name), resp.Status)
+	}
+
+	task.Requested = task.Demand
+	return true, nil
+}
+
+type app struct {
+	ID        string `json:"id"`
+	Instances int    `json:"instances"`
+}
+
+type appsResponse struct {
+	Apps []app `json:"apps"`
+}
+
+// CountAllTasks lists every app Marathon knows about and its current
+// instance count.
+func (s *Scheduler) CountAllTasks() (map[string]int, error) {
+	req, err := http.NewRequest("GET", s.addr+"/v2/apps", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("marathon GET /v2/apps: %s", resp.Status)
+	}
+
+	var parsed appsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(parsed.Apps))
+	for _, a := range parsed.Apps {
+		counts[strings.TrimPrefix(a.ID, "/")] = a.Instances
+	}
+	return counts, nil
+}
+
+// ReconcileTasks scales up to scheduler.Concurrency(len(tasks)) apps at
+// once: each is a separate Marathon app, so PUTs against different apps
+// don't contend with each other.
+func (s *Scheduler) ReconcileTasks(ctx context.Context, tasks map[string]demand.Task) (<-chan scheduler.TaskResult, error) {
+	return scheduler.RunPool(ctx, tasks, s.StopStartNTasks)
+}
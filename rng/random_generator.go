@@ -0,0 +1,48 @@
+// Package rng implements a demand.Input that makes up demand by random
+// walk, for exercising the rest of the pipeline without a real demand
+// source wired up.
+package rng
+
+import "math/rand"
+
+// maximum caps the random walk so demand stays within a small, easy to
+// reason about range.
+const maximum = 9
+
+// delta bounds how far a single step can move demand, so GetDemand produces
+// a gradual wander rather than a new unrelated value every call.
+const delta = 3
+
+// RandomDemandGenerator is a demand.Input whose demand for every task
+// follows the same random walk, seeded at the midpoint of its range.
+type RandomDemandGenerator struct {
+	current_demand int
+}
+
+// NewRandomDemandGenerator returns a RandomDemandGenerator seeded halfway
+// between 0 and maximum.
+func NewRandomDemandGenerator() *RandomDemandGenerator {
+	return &RandomDemandGenerator{current_demand: maximum / 2}
+}
+
+// NewDemandModel returns a demand.Input backed by a random walk. It
+// satisfies the same constructor convention as consul.NewDemandModel.
+func NewDemandModel() *RandomDemandGenerator {
+	return NewRandomDemandGenerator()
+}
+
+// GetDemand ignores taskName - every task shares the same random walk - and
+// returns the walk's next value, which is always within delta of the
+// previous one and clamped to [0, maximum].
+func (r *RandomDemandGenerator) GetDemand(taskName string) (int, error) {
+	step := rand.Intn(2*delta+1) - delta
+	next := r.current_demand + step
+	if next < 0 {
+		next = 0
+	}
+	if next > maximum {
+		next = maximum
+	}
+	r.current_demand = next
+	return next, nil
+}
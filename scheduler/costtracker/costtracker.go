@@ -0,0 +1,218 @@
+// Package costtracker measures the real wall-clock cost of scheduler
+// mutations and turns that into a token-bucket rate limit, so the main loop
+// can throttle itself before asking a back-end like Marathon or Compose for
+// another change, rather than firing changes off faster than the back-end
+// can actually service them. It's modelled on go-ethereum's LES cost
+// tracker: track a moving average of cost per unit of work, then police a
+// bucket of spendable time against it.
+package costtracker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ewmaAlpha weights how quickly the moving average reacts to a new sample;
+// the same value go-ethereum's LES cost tracker uses.
+const ewmaAlpha = 0.1
+
+// Tracker maintains an exponentially-weighted moving average of
+// cost-per-container-delta for one scheduler back-end, and polices a token
+// bucket of time budget built from that estimate.
+type Tracker struct {
+	mu sync.Mutex
+
+	backend      string
+	costPerDelta time.Duration // calibrated baseline cost per container started/stopped
+	correction   float64       // EWMA-updated correction factor on top of costPerDelta
+
+	bucket   time.Duration // time budget currently available
+	capacity time.Duration // bucket ceiling
+	last     time.Time
+}
+
+// NewTracker returns a Tracker for backend, seeded with an initial
+// cost-per-delta estimate (see Calibrate), an initial correction factor
+// (1 if none was persisted), and a token bucket of the given capacity that
+// refills at real time (one second of budget per elapsed second).
+func NewTracker(backend string, initialCostPerDelta time.Duration, initialCorrection float64, capacity time.Duration) *Tracker {
+	return &Tracker{
+		backend:      backend,
+		costPerDelta: initialCostPerDelta,
+		correction:   initialCorrection,
+		bucket:       capacity,
+		capacity:     capacity,
+		last:         time.Now(),
+	}
+}
+
+// replenish tops the bucket up with however much real time has passed since
+// it was last touched, capped at capacity.
+func (t *Tracker) replenish() {
+	now := time.Now()
+	t.bucket += now.Sub(t.last)
+	if t.bucket > t.capacity {
+		t.bucket = t.capacity
+	}
+	t.last = now
+}
+
+// Reserve checks out enough budget to cover nTasks container starts/stops
+// at the current cost estimate. If the bucket can cover it, it's debited
+// immediately and Reserve returns (0, true). Otherwise it returns how long
+// the caller should wait before the bucket will have refilled enough, and
+// false - the caller should defer the change rather than apply it now.
+func (t *Tracker) Reserve(nTasks int) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.replenish()
+
+	cost := time.Duration(float64(t.costPerDelta) * t.correction * float64(nTasks))
+	if cost <= t.bucket {
+		t.bucket -= cost
+		return 0, true
+	}
+
+	wait := cost - t.bucket
+	return wait, false
+}
+
+// Observe folds one real StopStartNTasks call's wall-clock cost into the
+// correction factor, given how many containers it started or stopped.
+// costPerDelta itself stays fixed at its calibrated value - it's how real
+// traffic is observed to drift away from that baseline (back-end under
+// load, different instance sizes, etc.) that correction tracks, as an EWMA
+// of observed-cost / costPerDelta.
+func (t *Tracker) Observe(nTasksDelta int, elapsed time.Duration) {
+	if nTasksDelta <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	perDelta := elapsed / time.Duration(nTasksDelta)
+	if t.costPerDelta == 0 {
+		// No calibrated baseline to correct against (e.g. calibration was
+		// skipped) - seed one from the first real observation instead.
+		t.costPerDelta = perDelta
+		return
+	}
+
+	ratio := float64(perDelta) / float64(t.costPerDelta)
+	t.correction = (1-ewmaAlpha)*t.correction + ewmaAlpha*ratio
+}
+
+// State is a snapshot of a Tracker's current cost estimate and budget,
+// suitable for reporting on the API so operators can see when they're
+// limit-bound.
+type State struct {
+	Backend      string        `json:"backend"`
+	CostPerDelta time.Duration `json:"costPerDeltaNanos"`
+	Available    time.Duration `json:"availableNanos"`
+	Capacity     time.Duration `json:"capacityNanos"`
+}
+
+// State returns a snapshot of t's current cost estimate and budget.
+func (t *Tracker) State() State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.replenish()
+
+	return State{
+		Backend:      t.backend,
+		CostPerDelta: t.costPerDelta,
+		Available:    t.bucket,
+		Capacity:     t.capacity,
+	}
+}
+
+// Calibrate benchmarks startStopN - which should reconcile some task to
+// demand n and back down again - at n = 1, 3 and 5, and returns the average
+// wall-clock cost-per-container-delta observed, for seeding a Tracker's
+// initial estimate before any real traffic has been observed.
+func Calibrate(startStopN func(n int) error) (time.Duration, error) {
+	var total time.Duration
+	var deltas int
+
+	for _, n := range []int{1, 3, 5} {
+		start := time.Now()
+		if err := startStopN(n); err != nil {
+			return 0, err
+		}
+		total += time.Since(start)
+		deltas += 2 * n // n started, then n stopped
+	}
+
+	return total / time.Duration(deltas), nil
+}
+
+// calibrationFile returns where backend's persisted correction factor
+// lives, under $HOME/.microscaling/.
+func calibrationFile(backend string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".microscaling", backend+".json"), nil
+}
+
+type calibration struct {
+	CostPerDeltaNanos int64   `json:"costPerDeltaNanos"`
+	Correction        float64 `json:"correction"`
+}
+
+// LoadCalibration reads back a previously persisted cost-per-delta estimate
+// and correction factor for backend, if one exists. A calibration file
+// saved before correction was persisted decodes with Correction at its zero
+// value, so that case is reported as 1 (no correction) rather than the
+// zero-cost bucket that a real 0 would produce.
+func LoadCalibration(backend string) (time.Duration, float64, bool) {
+	path, err := calibrationFile(backend)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var c calibration
+	if err := json.Unmarshal(data, &c); err != nil {
+		return 0, 0, false
+	}
+
+	correction := c.Correction
+	if correction == 0 {
+		correction = 1
+	}
+
+	return time.Duration(c.CostPerDeltaNanos), correction, true
+}
+
+// SaveCalibration persists costPerDelta and correction for backend so a
+// future run can seed its Tracker without re-benchmarking.
+func SaveCalibration(backend string, costPerDelta time.Duration, correction float64) error {
+	path, err := calibrationFile(backend)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(calibration{CostPerDeltaNanos: int64(costPerDelta), Correction: correction})
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,72 @@
+package costtracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserveDrainsAndRefillsBucket(t *testing.T) {
+	const costPerDelta = 10 * time.Millisecond
+	const capacity = 50 * time.Millisecond
+
+	tr := NewTracker("fake", costPerDelta, 1, capacity)
+
+	wait, ok := tr.Reserve(3)
+	if !ok || wait != 0 {
+		t.Fatalf("Reserve(3) = %v, %v; want 0, true", wait, ok)
+	}
+
+	wait, ok = tr.Reserve(3)
+	if ok {
+		t.Fatalf("Reserve(3) should have exceeded the remaining budget")
+	}
+	if wait <= 0 {
+		t.Fatalf("Reserve(3) wait = %v, want > 0", wait)
+	}
+
+	time.Sleep(capacity)
+
+	if wait, ok := tr.Reserve(5); !ok {
+		t.Fatalf("Reserve(5) after refill = %v, %v; want true", wait, ok)
+	}
+}
+
+func TestObserveAdjustsCorrectionTowardsRealCost(t *testing.T) {
+	const costPerDelta = 10 * time.Millisecond
+	const capacity = time.Second
+
+	tr := NewTracker("fake", costPerDelta, 1, capacity)
+
+	for i := 0; i < 50; i++ {
+		tr.Observe(1, 2*costPerDelta)
+	}
+
+	if got := tr.State().CostPerDelta; got != costPerDelta {
+		t.Fatalf("costPerDelta drifted from its calibrated baseline: got %v, want %v", got, costPerDelta)
+	}
+
+	before := tr.State().Available
+	if _, ok := tr.Reserve(1); !ok {
+		t.Fatalf("Reserve(1) unexpectedly exceeded the bucket")
+	}
+	spent := before - tr.State().Available
+
+	// Sustained 2x-cost observations should have pulled correction towards
+	// 2, so this reservation should cost close to 2*costPerDelta rather
+	// than costPerDelta.
+	if spent < 3*costPerDelta/2 {
+		t.Fatalf("Reserve(1) spent %v, want closer to 2x costPerDelta (%v) after correction adjusted upward", spent, costPerDelta)
+	}
+}
+
+func TestObserveIgnoresNonPositiveDelta(t *testing.T) {
+	// No calibrated baseline, so any observation Observe didn't ignore would
+	// seed costPerDelta from it.
+	tr := NewTracker("fake", 0, 1, time.Second)
+	tr.Observe(0, time.Hour)
+	tr.Observe(-1, time.Hour)
+
+	if got := tr.State().CostPerDelta; got != 0 {
+		t.Fatalf("costPerDelta changed after a non-positive delta observation: got %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"bitbucket.org/force12io/force12-scheduler/demand"
+)
+
+// defaultConcurrency is how many tasks a back-end's ReconcileTasks dispatches
+// to at once when F12_SCHED_CONCURRENCY isn't set.
+const defaultConcurrency = 4
+
+// Concurrency returns how many of a batch of nTasks ReconcileTasks should
+// dispatch to at once: F12_SCHED_CONCURRENCY if it's set to a positive
+// integer, otherwise defaultConcurrency - capped at nTasks either way.
+func Concurrency(nTasks int) int {
+	n := defaultConcurrency
+	if raw := os.Getenv("F12_SCHED_CONCURRENCY"); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			n = parsed
+		}
+	}
+	if nTasks < n {
+		n = nTasks
+	}
+	return n
+}
+
+// RunPool is the worker pool shared by the compose and marathon back-ends'
+// ReconcileTasks: it hands the tasks in the batch out to Concurrency(len(tasks))
+// workers, each pulling one task name at a time off a shared queue and
+// calling stopStartN for it, so no two workers ever touch the same task name
+// at once but unrelated names run in parallel.
+func RunPool(ctx context.Context, tasks map[string]demand.Task, stopStartN func(name string, task *demand.Task, ready chan struct{}) (bool, error)) (<-chan TaskResult, error) {
+	out := make(chan TaskResult, len(tasks))
+
+	names := make(chan string, len(tasks))
+	for name := range tasks {
+		names <- name
+	}
+	close(names)
+
+	n := Concurrency(len(tasks))
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if ctx.Err() != nil {
+					out <- TaskResult{Name: name, Err: ctx.Err()}
+					continue
+				}
+
+				task := tasks[name]
+				started := time.Now()
+				ready, err := stopStartN(name, &task, make(chan struct{}, 1))
+				out <- TaskResult{
+					Name:    name,
+					Task:    task,
+					Ready:   ready,
+					Elapsed: time.Since(started),
+					Err:     err,
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bitbucket.org/force12io/force12-scheduler/demand"
+)
+
+// TestRunPoolConcurrency fires a batch of randomized demand changes across
+// several tasks against a fake back-end with a fixed per-call latency, and
+// checks the pool gets the whole batch done in roughly sequential-time/N
+// rather than sequential-time.
+func TestRunPoolConcurrency(t *testing.T) {
+	const nTasks = 8
+	const nBatches = 1000
+	const latency = time.Millisecond
+
+	names := make([]string, nTasks)
+	for i := range names {
+		names[i] = fmt.Sprintf("task%d", i)
+	}
+
+	var calls int64
+	fakeStopStartN := func(name string, task *demand.Task, ready chan struct{}) (bool, error) {
+		time.Sleep(latency)
+		task.Requested = task.Demand
+		atomic.AddInt64(&calls, 1)
+		return true, nil
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	start := time.Now()
+	for i := 0; i < nBatches; i++ {
+		tasks := make(map[string]demand.Task, nTasks)
+		for _, name := range names {
+			tasks[name] = demand.Task{Demand: rng.Intn(10)}
+		}
+
+		results, err := RunPool(context.Background(), tasks, fakeStopStartN)
+		if err != nil {
+			t.Fatalf("RunPool: %v", err)
+		}
+		for range results {
+		}
+	}
+	elapsed := time.Since(start)
+
+	if got := atomic.LoadInt64(&calls); got != int64(nBatches*nTasks) {
+		t.Fatalf("want %d StopStartNTasks calls, got %d", nBatches*nTasks, got)
+	}
+
+	n := Concurrency(nTasks)
+	sequential := time.Duration(nBatches*nTasks) * latency
+	expected := sequential / time.Duration(n)
+
+	// Generous bounds: we just want to confirm the pool parallelizes across
+	// tasks rather than running them sequentially, not pin down an exact
+	// multiplier on a shared, possibly loaded, test machine.
+	if elapsed > sequential/2 {
+		t.Fatalf("RunPool took %v, expected roughly %v (sequential %v / %d workers) - tasks don't appear to be running concurrently", elapsed, expected, sequential, n)
+	}
+}
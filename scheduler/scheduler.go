@@ -0,0 +1,54 @@
+// Package scheduler defines the interface implemented by the back-ends
+// (compose, marathon) that actually start and stop containers.
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"bitbucket.org/force12io/force12-scheduler/demand"
+)
+
+// Scheduler starts, stops and counts the containers backing a set of named
+// tasks on a particular back-end.
+type Scheduler interface {
+	// InitScheduler prepares the named task so that StopStartNTasks can
+	// start instances of it.
+	InitScheduler(name string) error
+
+	// StopStartNTasks reconciles the named task towards task.Demand,
+	// signalling completion on ready. It returns whether the scheduler is
+	// ready to accept another change, and any error encountered.
+	StopStartNTasks(name string, task *demand.Task, ready chan struct{}) (bool, error)
+
+	// CountAllTasks returns the currently running instance count for every
+	// task the back-end knows about, keyed by task name.
+	CountAllTasks() (map[string]int, error)
+
+	// ReconcileTasks reconciles every task in tasks towards its Demand,
+	// across a bounded worker pool (see Concurrency) so that one slow task
+	// doesn't hold up the others. Each task name is only ever handled by one
+	// worker at a time, but different names run concurrently. It returns one
+	// TaskResult per task on the returned channel, which is closed once
+	// they've all been serviced.
+	ReconcileTasks(ctx context.Context, tasks map[string]demand.Task) (<-chan TaskResult, error)
+}
+
+// TaskResult reports the outcome of reconciling one task as part of a
+// ReconcileTasks batch.
+type TaskResult struct {
+	Name string
+	Task demand.Task // the task as left after reconciling (Requested updated)
+
+	// Ready reports whether the scheduler is ready to accept another change
+	// for Name straight away. Callers should hold off reconciling this task
+	// again until Ready is true, so a task that's still busy doesn't get a
+	// second change piled on top of the first.
+	Ready bool
+
+	// Elapsed is the wall-clock time the underlying StopStartNTasks call
+	// took, for feeding a costtracker.Tracker.
+	Elapsed time.Duration
+
+	Err error
+}
@@ -0,0 +1,160 @@
+// Package wdrr implements Weighted Deficit Round Robin allocation of a fixed
+// pool of slots (e.g. const_maxcontainers) across any number of priority
+// tiers, replacing the hard-coded two-tier P1/P2 split that used to be baked
+// into main.go's Demand.update.
+package wdrr
+
+import (
+	"sort"
+
+	"bitbucket.org/force12io/force12-scheduler/demand"
+)
+
+// Scheduler allocates a fixed capacity of slots across a set of named tasks
+// each round, carrying unused deficit forward so lower-weight tiers aren't
+// starved even when higher-weight tiers keep demand saturated.
+//
+// A Scheduler must be reused across successive AllocateSlots calls - it is
+// the carried deficit that guarantees starvation-freedom when total demand
+// exceeds capacity indefinitely.
+type Scheduler struct {
+	// StrictPriority, if non-empty, names a task that is serviced to its
+	// full demand (capped by MaxDemand) before the remaining capacity is
+	// shared out by WDRR - analogous to the free-peer priority in geth's LES
+	// cost tracker. Empty string disables strict-priority mode.
+	StrictPriority string
+
+	deficit map[string]int
+}
+
+// NewScheduler returns a Scheduler with no strict-priority tier.
+func NewScheduler() *Scheduler {
+	return &Scheduler{deficit: make(map[string]int)}
+}
+
+// AllocateSlots runs one WDRR round over tasks and returns the number of
+// slots each task is granted this round. capacity is the total pool size
+// for the round.
+func (s *Scheduler) AllocateSlots(tasks map[string]demand.Task, capacity int) map[string]int {
+	if s.deficit == nil {
+		s.deficit = make(map[string]int)
+	}
+
+	allocation := make(map[string]int, len(tasks))
+	remaining := capacity
+
+	if s.StrictPriority != "" {
+		if task, ok := tasks[s.StrictPriority]; ok {
+			give := task.Demand
+			if task.MaxDemand > 0 && give > task.MaxDemand {
+				give = task.MaxDemand
+			}
+			if give > remaining {
+				give = remaining
+			}
+			if give > 0 {
+				allocation[s.StrictPriority] = give
+				remaining -= give
+			}
+		}
+	}
+
+	// Fixed order is required for the deficit counters to mean anything
+	// round over round.
+	order := make([]string, 0, len(tasks))
+	for name := range tasks {
+		if name == s.StrictPriority {
+			continue
+		}
+		order = append(order, name)
+	}
+	sort.Strings(order)
+
+	outstanding := func(name string) int {
+		task := tasks[name]
+		left := task.Demand - allocation[name]
+		if task.MaxDemand > 0 {
+			if headroom := task.MaxDemand - allocation[name]; headroom < left {
+				left = headroom
+			}
+		}
+		return left
+	}
+
+	// Standard DRR deficit-counter behaviour: a task with nothing outstanding
+	// this round has its deficit reset to zero rather than left to carry
+	// over, so a tier that's been idle doesn't bank an unbounded IOU it can
+	// cash in as a burst the moment demand returns.
+	for _, name := range order {
+		if outstanding(name) <= 0 {
+			s.deficit[name] = 0
+		}
+	}
+
+	// Hand out one slot per task per cycle, round-robin in the fixed order,
+	// rather than draining one task's whole deficit before moving on -
+	// that's what stops a high-weight task exhausting the pool before a
+	// low-weight task even gets a look in this round. When every task's
+	// deficit runs dry in the same cycle but capacity and demand both
+	// remain, credit another round's worth of Weight to whoever still wants
+	// more and keep going, rather than falling back to handing the
+	// remainder out in a fixed, unweighted order - that fixed order is what
+	// let whichever task sorts first always win any leftover capacity.
+	//
+	// Weight <= 0 can't be credited - crediting zero forever would spin
+	// this loop without end - so such a task never earns a round-robin
+	// slot here; once no creditable task has outstanding demand either, any
+	// remainder still wanted by a non-positive-weight task is handed out in
+	// fixed order below instead.
+	for remaining > 0 {
+		progressed := false
+		for _, name := range order {
+			if remaining <= 0 {
+				break
+			}
+			if s.deficit[name] < 1 || outstanding(name) <= 0 {
+				continue
+			}
+			allocation[name]++
+			s.deficit[name]--
+			remaining--
+			progressed = true
+		}
+		if progressed {
+			continue
+		}
+
+		anyCreditable := false
+		for _, name := range order {
+			if tasks[name].Weight > 0 && outstanding(name) > 0 {
+				s.deficit[name] += tasks[name].Weight
+				anyCreditable = true
+			}
+		}
+		if !anyCreditable {
+			break
+		}
+	}
+
+	// Any task left with outstanding demand at this point has a non-positive
+	// Weight (AllocateSlots never leaves remaining > 0 above while a
+	// positive-weight task still wants more) - hand out what's left in
+	// fixed order rather than looping on a weight that can never be
+	// credited.
+	for _, name := range order {
+		if remaining <= 0 {
+			break
+		}
+		give := outstanding(name)
+		if give <= 0 {
+			continue
+		}
+		if give > remaining {
+			give = remaining
+		}
+		allocation[name] += give
+		remaining -= give
+	}
+
+	return allocation
+}
@@ -0,0 +1,157 @@
+package wdrr
+
+import (
+	"testing"
+	"time"
+
+	"bitbucket.org/force12io/force12-scheduler/demand"
+)
+
+func TestAllocateSlotsFairness(t *testing.T) {
+	tasks := map[string]demand.Task{
+		"critical": {Demand: 1000, Weight: 1},
+		"batch":    {Demand: 1000, Weight: 3},
+		"preview":  {Demand: 1000, Weight: 2},
+	}
+
+	const capacity = 6
+	const rounds = 2000
+	const totalWeight = 1 + 3 + 2
+
+	sched := NewScheduler()
+	totals := map[string]int{}
+
+	for i := 0; i < rounds; i++ {
+		for name, got := range sched.AllocateSlots(tasks, capacity) {
+			totals[name] += got
+		}
+	}
+
+	for name, task := range tasks {
+		want := float64(task.Weight) / float64(totalWeight)
+		got := float64(totals[name]) / float64(rounds*capacity)
+		if diff := want - got; diff > 0.02 || diff < -0.02 {
+			t.Errorf("task %s: allocation ratio %.3f, want ~%.3f", name, got, want)
+		}
+	}
+}
+
+func TestAllocateSlotsStarvationFree(t *testing.T) {
+	tasks := map[string]demand.Task{
+		"critical": {Demand: 1000, Weight: 50},
+		"trickle":  {Demand: 1000, Weight: 1},
+	}
+
+	sched := NewScheduler()
+	served := false
+	for i := 0; i < 1000; i++ {
+		allocation := sched.AllocateSlots(tasks, 5)
+		if allocation["trickle"] > 0 {
+			served = true
+			break
+		}
+	}
+
+	if !served {
+		t.Fatalf("trickle task starved over 1000 rounds")
+	}
+}
+
+// TestAllocateSlotsNoBurstAfterIdle guards against an idle task's deficit
+// accumulating into an unbounded IOU: a task sitting at zero demand must not
+// bank Weight every round, or the instant it wants slots again it cashes in
+// the whole backlog in one round at the expense of a task that had been
+// continuously and fairly served the entire time.
+func TestAllocateSlotsNoBurstAfterIdle(t *testing.T) {
+	tasks := map[string]demand.Task{
+		"active": {Demand: 1000, Weight: 1},
+		"idle":   {Demand: 0, Weight: 1},
+	}
+
+	const capacity = 5
+
+	sched := NewScheduler()
+	for i := 0; i < 500; i++ {
+		sched.AllocateSlots(tasks, capacity)
+	}
+
+	idle := tasks["idle"]
+	idle.Demand = 1000
+	tasks["idle"] = idle
+
+	allocation := sched.AllocateSlots(tasks, capacity)
+	if diff := allocation["idle"] - allocation["active"]; diff > 1 || diff < -1 {
+		t.Fatalf("allocation burst after idle period: active=%d idle=%d, want roughly even split", allocation["active"], allocation["idle"])
+	}
+}
+
+func TestAllocateSlotsStrictPriority(t *testing.T) {
+	tasks := map[string]demand.Task{
+		"p1": {Demand: 5, Weight: 1, MaxDemand: 9},
+		"p2": {Demand: 10, Weight: 1},
+	}
+
+	sched := NewScheduler()
+	sched.StrictPriority = "p1"
+
+	allocation := sched.AllocateSlots(tasks, 9)
+	if allocation["p1"] != 5 {
+		t.Fatalf("strict-priority task got %d, want 5", allocation["p1"])
+	}
+	if allocation["p2"] != 4 {
+		t.Fatalf("remaining task got %d, want 4", allocation["p2"])
+	}
+}
+
+// TestAllocateSlotsZeroWeightDoesNotHang guards against a misconfigured
+// (e.g. typo'd) zero- or negative-weight task wedging AllocateSlots forever:
+// such a task can never be credited deficit, so crediting weight to "make
+// progress" on a stalled cycle must not loop on it - its outstanding demand
+// has to be handed out in fixed order instead, same as if it had no
+// deficit-based path to slots at all.
+func TestAllocateSlotsZeroWeightDoesNotHang(t *testing.T) {
+	tasks := map[string]demand.Task{
+		"zero": {Demand: 10, Weight: 0},
+	}
+
+	sched := NewScheduler()
+
+	done := make(chan map[string]int, 1)
+	go func() { done <- sched.AllocateSlots(tasks, 5) }()
+
+	select {
+	case allocation := <-done:
+		if allocation["zero"] != 5 {
+			t.Fatalf("zero-weight task got %d, want 5 (the full capacity)", allocation["zero"])
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("AllocateSlots did not return within 1s - zero-weight task likely spun the credit loop forever")
+	}
+}
+
+// TestAllocateSlotsZeroWeightAlongsidePositive checks a zero-weight task
+// doesn't starve the deficit-based allocation a positive-weight task is
+// entitled to, and only picks up what's left over.
+func TestAllocateSlotsZeroWeightAlongsidePositive(t *testing.T) {
+	tasks := map[string]demand.Task{
+		"zero":   {Demand: 10, Weight: 0},
+		"active": {Demand: 2, Weight: 1},
+	}
+
+	sched := NewScheduler()
+
+	done := make(chan map[string]int, 1)
+	go func() { done <- sched.AllocateSlots(tasks, 5) }()
+
+	select {
+	case allocation := <-done:
+		if allocation["active"] != 2 {
+			t.Fatalf("active task got %d, want 2 (its full demand)", allocation["active"])
+		}
+		if allocation["zero"] != 3 {
+			t.Fatalf("zero-weight task got %d, want 3 (the leftover capacity)", allocation["zero"])
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("AllocateSlots did not return within 1s")
+	}
+}
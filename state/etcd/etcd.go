@@ -0,0 +1,222 @@
+// Package etcd implements state.Store against etcd's v3 API (via its JSON
+// gateway, so no client library needs to be vendored), using the same
+// read-modify-write compare-and-swap pattern kube-apiserver's etcd3 store
+// uses: read the key's current value and mod_revision, build the new value,
+// then commit with Txn().If(mod_revision unchanged).Then(put), falling back
+// to a re-read and retry if a concurrent writer won the race.
+package etcd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"bitbucket.org/force12io/force12-scheduler/state"
+)
+
+// maxRetries bounds how many times Save re-reads and retries its
+// compare-and-swap before giving up in the face of contention.
+const maxRetries = 5
+
+// Store is a state.Store backed by etcd, suitable for sharing state across
+// multiple Force12 replicas.
+type Store struct {
+	addr      string
+	client    *http.Client
+	retention time.Duration
+}
+
+// NewStore returns a Store pointed at the etcd cluster named by ETCD_ADDR
+// (defaulting to the local agent). Samples older than retention are
+// trimmed on every Save, since History never looks back further than that
+// anyway; retention of 0 disables trimming.
+func NewStore(retention time.Duration) *Store {
+	addr := os.Getenv("ETCD_ADDR")
+	if addr == "" {
+		addr = "http://localhost:2379"
+	}
+	return &Store{addr: addr, client: http.DefaultClient, retention: retention}
+}
+
+func (s *Store) key(name string) string {
+	return "force12/state/" + name
+}
+
+// record is what's actually stored under a task's key: its full sample
+// history, JSON-encoded and base64'd into etcd's value field.
+type record struct {
+	Samples []state.Sample `json:"samples"`
+}
+
+type rangeKV struct {
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type rangeResponse struct {
+	Kvs []rangeKV `json:"kvs"`
+}
+
+// get reads name's current record and mod_revision (0 if the key doesn't
+// exist yet).
+func (s *Store) get(name string) (record, int64, error) {
+	reqBody, err := json.Marshal(map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(s.key(name))),
+	})
+	if err != nil {
+		return record{}, 0, err
+	}
+
+	resp, err := s.client.Post(s.addr+"/v3/kv/range", "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return record{}, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return record{}, 0, fmt.Errorf("etcd kv range %s: %s", s.key(name), resp.Status)
+	}
+
+	var parsed rangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return record{}, 0, err
+	}
+	if len(parsed.Kvs) == 0 {
+		return record{}, 0, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(parsed.Kvs[0].Value)
+	if err != nil {
+		return record{}, 0, err
+	}
+
+	var rec record
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return record{}, 0, err
+	}
+
+	modRevision, err := strconv.ParseInt(parsed.Kvs[0].ModRevision, 10, 64)
+	if err != nil {
+		return record{}, 0, err
+	}
+
+	return rec, modRevision, nil
+}
+
+// txnPut commits rec for name via a transaction that only succeeds if the
+// key's mod_revision still matches modRevision - i.e. nothing else wrote to
+// it since get read it.
+func (s *Store) txnPut(name string, rec record, modRevision int64) (bool, error) {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return false, err
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(s.key(name)))
+	txn := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":          key,
+			"target":       "MOD",
+			"result":       "EQUAL",
+			"mod_revision": strconv.FormatInt(modRevision, 10),
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": map[string]string{
+				"key":   key,
+				"value": base64.StdEncoding.EncodeToString(value),
+			},
+		}},
+	}
+
+	body, err := json.Marshal(txn)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := s.client.Post(s.addr+"/v3/kv/txn", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("etcd kv txn %s: %s", s.key(name), resp.Status)
+	}
+
+	var parsed struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return false, err
+	}
+	return parsed.Succeeded, nil
+}
+
+// Save appends name's latest sample via read-modify-write compare-and-swap,
+// trimming anything older than retention (if set) before writing back, and
+// retrying against the loser's freshly-read mod_revision if a concurrent
+// writer won the race.
+func (s *Store) Save(name string, t time.Time, demand, requested int) error {
+	for i := 0; i < maxRetries; i++ {
+		rec, modRevision, err := s.get(name)
+		if err != nil {
+			return err
+		}
+
+		rec.Samples = append(rec.Samples, state.Sample{Time: t, Demand: demand, Requested: requested})
+		if s.retention > 0 {
+			rec.Samples = trim(rec.Samples, t.Add(-s.retention))
+		}
+
+		ok, err := s.txnPut(name, rec, modRevision)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		// Lost the race to a concurrent writer - get will pick up the new
+		// mod_revision next time round.
+	}
+
+	return fmt.Errorf("etcd: too much contention saving state for %s", name)
+}
+
+// Last returns name's most recently saved sample, if any.
+func (s *Store) Last(name string) (state.Sample, bool, error) {
+	rec, _, err := s.get(name)
+	if err != nil {
+		return state.Sample{}, false, err
+	}
+	if len(rec.Samples) == 0 {
+		return state.Sample{}, false, nil
+	}
+	return rec.Samples[len(rec.Samples)-1], true, nil
+}
+
+// History returns every sample saved for name at or after since, oldest
+// first.
+func (s *Store) History(name string, since time.Time) ([]state.Sample, error) {
+	rec, _, err := s.get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := trim(rec.Samples, since)
+	out := make([]state.Sample, len(matched))
+	copy(out, matched)
+	return out, nil
+}
+
+// trim drops every sample older than since, taking advantage of samples
+// already being in time order.
+func trim(samples []state.Sample, since time.Time) []state.Sample {
+	i := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(since) })
+	return samples[i:]
+}
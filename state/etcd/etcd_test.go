@@ -0,0 +1,167 @@
+package etcd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is a minimal in-memory stand-in for etcd's v3 JSON gateway,
+// enough to exercise Store's read-modify-write compare-and-swap loop:
+// /v3/kv/range returns the current value and mod_revision, /v3/kv/txn
+// applies the put only if mod_revision still matches.
+type fakeEtcd struct {
+	mu          sync.Mutex
+	value       string
+	modRevision int64
+
+	// failTxns forces this many otherwise-successful transactions to
+	// report a lost compare-and-swap race before one is allowed through,
+	// so Save's retry loop actually gets exercised.
+	failTxns int
+}
+
+func (f *fakeEtcd) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			resp := rangeResponse{}
+			if f.modRevision > 0 {
+				resp.Kvs = []rangeKV{{
+					Value:       f.value,
+					ModRevision: strconv.FormatInt(f.modRevision, 10),
+				}}
+			}
+			json.NewEncoder(w).Encode(resp)
+
+		case "/v3/kv/txn":
+			var req struct {
+				Compare []struct {
+					ModRevision string `json:"mod_revision"`
+				} `json:"compare"`
+				Success []struct {
+					RequestPut struct {
+						Value string `json:"value"`
+					} `json:"request_put"`
+				} `json:"success"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			succeeded := strconv.FormatInt(f.modRevision, 10) == req.Compare[0].ModRevision
+			if succeeded && f.failTxns > 0 {
+				f.failTxns--
+				succeeded = false
+			}
+			if succeeded {
+				f.value = req.Success[0].RequestPut.Value
+				f.modRevision++
+			}
+
+			json.NewEncoder(w).Encode(struct {
+				Succeeded bool `json:"succeeded"`
+			}{succeeded})
+
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func newTestStore(t *testing.T, f *fakeEtcd, retention time.Duration) *Store {
+	t.Helper()
+	server := httptest.NewServer(f.handler())
+	t.Cleanup(server.Close)
+
+	s := NewStore(retention)
+	s.addr = server.URL
+	return s
+}
+
+func TestSaveLastHistory(t *testing.T) {
+	s := newTestStore(t, &fakeEtcd{}, 0)
+
+	base := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := s.Save("task", base.Add(time.Duration(i)*time.Minute), i, i); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	last, ok, err := s.Last("task")
+	if err != nil || !ok || last.Demand != 2 {
+		t.Fatalf("Last = %v, %v, %v; want demand 2", last, ok, err)
+	}
+
+	history, err := s.History("task", base.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("History returned %d samples, want 2", len(history))
+	}
+}
+
+// TestSaveRetriesOnLostRace checks Save retries its compare-and-swap
+// against a freshly re-read mod_revision when a concurrent writer wins the
+// race, rather than giving up after the first conflict.
+func TestSaveRetriesOnLostRace(t *testing.T) {
+	f := &fakeEtcd{failTxns: maxRetries - 1}
+	s := newTestStore(t, f, 0)
+
+	if err := s.Save("task", time.Now(), 1, 1); err != nil {
+		t.Fatalf("Save should have succeeded after retrying past the lost races: %v", err)
+	}
+
+	last, ok, err := s.Last("task")
+	if err != nil || !ok || last.Demand != 1 {
+		t.Fatalf("Last = %v, %v, %v; want demand 1", last, ok, err)
+	}
+}
+
+// TestSaveGivesUpAfterMaxRetries checks Save reports an error rather than
+// retrying forever when every attempt loses the compare-and-swap race.
+func TestSaveGivesUpAfterMaxRetries(t *testing.T) {
+	f := &fakeEtcd{failTxns: maxRetries}
+	s := newTestStore(t, f, 0)
+
+	if err := s.Save("task", time.Now(), 1, 1); err == nil {
+		t.Fatalf("Save should have given up after %d failed compare-and-swap attempts", maxRetries)
+	}
+}
+
+func TestSaveTrimsOlderThanRetention(t *testing.T) {
+	const retention = 10 * time.Minute
+	s := newTestStore(t, &fakeEtcd{}, retention)
+
+	base := time.Now()
+	if err := s.Save("task", base, 1, 1); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := s.Save("task", base.Add(retention+time.Minute), 2, 2); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	history, err := s.History("task", time.Time{})
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("History returned %d samples after retention trim, want 1", len(history))
+	}
+	if history[0].Demand != 2 {
+		t.Fatalf("surviving sample has demand %d, want 2 (the most recent)", history[0].Demand)
+	}
+}
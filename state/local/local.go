@@ -0,0 +1,119 @@
+// Package local implements state.Store as a single JSON file on disk, for
+// running Force12 without an external store.
+package local
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"bitbucket.org/force12io/force12-scheduler/state"
+)
+
+// defaultPath is where Store persists state when NewStore isn't given one,
+// alongside costtracker's calibration files.
+func defaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".microscaling", "state.json"), nil
+}
+
+// Store is a state.Store backed by a JSON file, rewritten in full on every
+// Save. It's meant for a single local Force12 process, not for sharing
+// state across replicas - see state/etcd for that.
+type Store struct {
+	mu        sync.Mutex
+	path      string
+	retention time.Duration
+
+	samples map[string][]state.Sample
+}
+
+// NewStore opens (or creates) a Store backed by the JSON file at path. An
+// empty path uses defaultPath(). Samples older than retention are trimmed
+// on every Save, since History never looks back further than that anyway.
+func NewStore(path string, retention time.Duration) (*Store, error) {
+	if path == "" {
+		p, err := defaultPath()
+		if err != nil {
+			return nil, err
+		}
+		path = p
+	}
+
+	s := &Store{path: path, retention: retention, samples: make(map[string][]state.Sample)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.samples); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// trim drops every sample older than since, taking advantage of samples
+// already being in time order.
+func trim(samples []state.Sample, since time.Time) []state.Sample {
+	i := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(since) })
+	return samples[i:]
+}
+
+// Save appends name's latest sample, trims anything older than retention
+// (if retention is set), and rewrites the backing file.
+func (s *Store) Save(name string, t time.Time, demand, requested int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := append(s.samples[name], state.Sample{Time: t, Demand: demand, Requested: requested})
+	if s.retention > 0 {
+		samples = trim(samples, t.Add(-s.retention))
+	}
+	s.samples[name] = samples
+
+	data, err := json.Marshal(s.samples)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0o644)
+}
+
+// Last returns name's most recently saved sample, if any.
+func (s *Store) Last(name string) (state.Sample, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	samples := s.samples[name]
+	if len(samples) == 0 {
+		return state.Sample{}, false, nil
+	}
+	return samples[len(samples)-1], true, nil
+}
+
+// History returns every sample saved for name at or after since, oldest
+// first. Samples are appended in time order, so this is a binary search
+// rather than a full scan.
+func (s *Store) History(name string, since time.Time) ([]state.Sample, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matched := trim(s.samples[name], since)
+	out := make([]state.Sample, len(matched))
+	copy(out, matched)
+	return out, nil
+}
@@ -0,0 +1,76 @@
+package local
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLastHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := NewStore(path, 0)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	base := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := s.Save("task", base.Add(time.Duration(i)*time.Minute), i, i); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	last, ok, err := s.Last("task")
+	if err != nil || !ok {
+		t.Fatalf("Last: %v, %v, %v", last, ok, err)
+	}
+	if last.Demand != 2 {
+		t.Fatalf("Last demand = %d, want 2", last.Demand)
+	}
+
+	history, err := s.History("task", base.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("History returned %d samples, want 2", len(history))
+	}
+
+	// A freshly reopened Store should see what was persisted.
+	reopened, err := NewStore(path, 0)
+	if err != nil {
+		t.Fatalf("reopen NewStore: %v", err)
+	}
+	if last, ok, err := reopened.Last("task"); err != nil || !ok || last.Demand != 2 {
+		t.Fatalf("reopened Last = %v, %v, %v", last, ok, err)
+	}
+}
+
+func TestSaveTrimsOlderThanRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	const retention = 10 * time.Minute
+
+	s, err := NewStore(path, retention)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+
+	base := time.Now()
+	if err := s.Save("task", base, 1, 1); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := s.Save("task", base.Add(retention+time.Minute), 2, 2); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	history, err := s.History("task", time.Time{})
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("History returned %d samples after retention trim, want 1", len(history))
+	}
+	if history[0].Demand != 2 {
+		t.Fatalf("surviving sample has demand %d, want 2 (the most recent)", history[0].Demand)
+	}
+}
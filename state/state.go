@@ -0,0 +1,35 @@
+// Package state defines the persistence contract for demand history and
+// crash recovery: what was last demanded of and requested from the
+// scheduler for each task, and when. Concrete backends (state/local,
+// state/etcd) implement Store against a JSON file or etcd, respectively.
+package state
+
+import "time"
+
+// Sample is one (timestamp, demand, requested) observation for a task.
+// Requested is the instance count most recently asked of the scheduler
+// back-end (demand.Task.Requested) - back-ends like compose and marathon
+// set it to their target the moment a scale call is accepted, not once
+// it's confirmed running, so it can lag reality while a change is still
+// converging.
+type Sample struct {
+	Time      time.Time `json:"time"`
+	Demand    int       `json:"demand"`
+	Requested int       `json:"requested"`
+}
+
+// Store persists demand/requested history per task, so a restart can
+// recover the last known state instead of starting blind, and so a
+// dashboard can show a trend rather than only the latest point.
+type Store interface {
+	// Save appends name's latest (demand, requested) observation at t.
+	Save(name string, t time.Time, demand, requested int) error
+
+	// Last returns the most recently saved sample for name, if any has ever
+	// been saved.
+	Last(name string) (Sample, bool, error)
+
+	// History returns every sample saved for name at or after since, oldest
+	// first.
+	History(name string, since time.Time) ([]Sample, error)
+}